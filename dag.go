@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"sync"
+	"text/template"
+
+	vartemplate "github.com/zongzw/f5-oslbaasv2-ops/template"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Stage is one phase of a multi-stage template: a command template plus
+// its own static variables, optionally bound to fields captured out of its
+// parent stage's CommandResult.
+type Stage struct {
+	Name      string            `yaml:"name"`
+	Command   string            `yaml:"command"`
+	Variables map[string]string `yaml:"variables"`
+	Needs     string            `yaml:"needs"`
+	Bind      map[string]string `yaml:"bind"`
+}
+
+// StageFile is the top-level shape of a `-stages` YAML file.
+type StageFile struct {
+	Stages []Stage `yaml:"stages"`
+}
+
+// LoadStageFile reads and parses a `-stages` YAML file.
+func LoadStageFile(path string) (StageFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return StageFile{}, err
+	}
+
+	var sf StageFile
+	if err := yaml.Unmarshal(b, &sf); err != nil {
+		return StageFile{}, err
+	}
+	return sf, nil
+}
+
+// dagNode is one concrete, fully-expanded command awaiting execution,
+// tagged with the stage it was generated from.
+type dagNode struct {
+	stage Stage
+	cmd   string
+}
+
+// RunStages executes a multi-stage YAML template as a DAG: every generated
+// command runs through the same bounded `-concurrency` worker semaphore,
+// `-serial` per-resource-type mutual exclusion, `-rate` limiting and
+// `-timeout`/driver the flat CLI's worker pool uses (see executeCommand),
+// and on completion of a parent command its `bind:` clause is evaluated
+// against the command's CommandResult to produce the dynamic variables a
+// child stage's %{name} placeholders resolve against.
+func RunStages(sf StageFile) []CommandResult {
+	childrenOf := map[string][]Stage{}
+	for _, s := range sf.Stages {
+		childrenOf[s.Needs] = append(childrenOf[s.Needs], s)
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+
+	serialPermits := newSerialPermits()
+	limiter := newRateLimiter()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	results := []CommandResult{}
+
+	var run func(node dagNode)
+	run = func(node dagNode) {
+		defer wg.Done()
+
+		sem <- struct{}{}
+		defer func() { <-sem }()
+
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		logger.Printf("Stage %q: '%s' starts\n", node.stage.Name, node.cmd)
+		cr := executeCommand(ctx, node.cmd, limiter, serialPermits)
+		logger.Printf("Stage %q: '%s' exits with: %d, executing time: %s\n", node.stage.Name, cr.Command, cr.ExitCode, cr.Duration)
+
+		mu.Lock()
+		cr.Seq = len(results)
+		results = append(results, cr)
+		mu.Unlock()
+
+		if cr.ExitCode != 0 {
+			return
+		}
+
+		for _, child := range childrenOf[node.stage.Name] {
+			dyn, err := bindVars(node.cmd, child, cr)
+			if err != nil {
+				logger.Printf("Stage %q: failed to bind variables for child %q: %s\n", node.stage.Name, child.Name, err)
+				continue
+			}
+
+			for _, childCmd := range expandStage(child, dyn) {
+				progress.Queued(ResourceType(childCmd))
+				wg.Add(1)
+				go run(dagNode{stage: child, cmd: childCmd})
+			}
+		}
+	}
+
+	for _, root := range childrenOf[""] {
+		for _, cmd := range expandStage(root, nil) {
+			progress.Queued(ResourceType(cmd))
+			wg.Add(1)
+			go run(dagNode{stage: root, cmd: cmd})
+		}
+	}
+
+	wg.Wait()
+	return results
+}
+
+// expandStage resolves a stage's command template against its own static
+// variables, overridden by any dynamic variables bound from a parent
+// stage's result.
+func expandStage(s Stage, dyn vartemplate.DynamicResolver) []string {
+	static := vartemplate.StaticResolver{}
+	for name, spec := range s.Variables {
+		static[name] = vartemplate.ParseValues(spec)
+	}
+	return vartemplate.Expand(s.Command, combinedResolver{dynamic: dyn, static: static})
+}
+
+// combinedResolver checks a stage's dynamic, parent-bound variables first,
+// falling back to its own static variables.
+type combinedResolver struct {
+	dynamic vartemplate.DynamicResolver
+	static  vartemplate.StaticResolver
+}
+
+// Values implements vartemplate.Resolver.
+func (c combinedResolver) Values(name string) ([]string, bool) {
+	if c.dynamic != nil {
+		if v, ok := c.dynamic.Values(name); ok {
+			return v, ok
+		}
+	}
+	return c.static.Values(name)
+}
+
+// bindVars evaluates child's `bind:` clause against parentResult, the
+// CommandResult of the already-expanded parentCmd, producing the dynamic
+// variables child's %{name} placeholders resolve against. A bind
+// expression is a text/template referencing the parent resource's fields,
+// e.g. "{{ .loadbalancer.id }}".
+func bindVars(parentCmd string, child Stage, parentResult CommandResult) (vartemplate.DynamicResolver, error) {
+	dyn := vartemplate.DynamicResolver{}
+	if len(child.Bind) == 0 {
+		return dyn, nil
+	}
+
+	data := map[string]interface{}{
+		ResourceType(parentCmd): parentResult.Out,
+	}
+
+	for name, expr := range child.Bind {
+		t, err := template.New(name).Parse(expr)
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		dyn[name] = buf.String()
+	}
+	return dyn, nil
+}
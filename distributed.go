@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	redis "github.com/go-redis/redis/v7"
+)
+
+const (
+	redisLeaseTTL     = 5 * time.Minute
+	redisReapInterval = 30 * time.Second
+)
+
+// redisKeys names the Redis keys one batch's cooperating nodes share. They're
+// namespaced under a hash of cmdPrefix+cmdList so that two unrelated runs of
+// this tool against the same `-redis` address never collide: without this, a
+// second run would find the first run's "seeded" flag already set and its
+// "pending" counter already at zero, and would hand back the first run's
+// stale results having executed none of its own commands.
+type redisKeys struct {
+	ns string
+}
+
+// newRedisKeys derives a batch's key namespace deterministically from its
+// command list, so every node running the same batch computes the same
+// namespace independently, with no extra coordination required.
+func newRedisKeys(cmdList []string) redisKeys {
+	h := fnv.New64a()
+	for _, n := range cmdList {
+		fmt.Fprintf(h, "%s%s\n", cmdPrefix, n)
+	}
+	return redisKeys{ns: fmt.Sprintf("oslbaas:%x", h.Sum64())}
+}
+
+func (k redisKeys) queue() string      { return k.ns + ":queue" }
+func (k redisKeys) processing() string { return k.ns + ":processing" }
+func (k redisKeys) results() string    { return k.ns + ":results" }
+func (k redisKeys) pending() string    { return k.ns + ":pending" }
+func (k redisKeys) seeded() string     { return k.ns + ":seeded" }
+func (k redisKeys) lease(seq int) string {
+	return fmt.Sprintf("%s:lease:%d", k.ns, seq)
+}
+
+// redisJob is one command as queued in Redis, decorated with its sequence
+// number so results can be reassembled in order.
+type redisJob struct {
+	Seq int    `json:"seq"`
+	Cmd string `json:"cmd"`
+}
+
+// RunCmdsDistributed pushes cmdList onto a Redis list so multiple instances
+// of this tool, on different hosts, can cooperate on the same batch: each
+// instance BRPOPLPUSHes a job into a processing list, takes a `SET NX PX`
+// lease on it for ownership, runs it, and moves the result into a Redis
+// hash keyed by seqnum. Whichever node notices every command has a result
+// assembles and returns the final, sequence-ordered CommandResult slice.
+//
+// Per-resource-type `-serial` ordering is not coordinated across nodes in
+// this mode, only within a single node's own workers.
+func RunCmdsDistributed(addr string, resumed map[string]CommandResult, jw *journalWriter) []CommandResult {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	defer client.Close()
+
+	id := workerID()
+	rk := newRedisKeys(cmdList)
+	seedRedisQueue(client, rk, resumed)
+
+	stopReaper := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(redisReapInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				reapOrphanedLeases(client, rk)
+			case <-stopReaper:
+				return
+			}
+		}
+	}()
+	defer close(stopReaper)
+
+	serialPermits := newSerialPermits()
+	limiter := newRateLimiter()
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			redisWorker(client, rk, id, jw, limiter, serialPermits)
+		}()
+	}
+	wg.Wait()
+
+	return assembleRedisResults(client, rk)
+}
+
+// reapOrphanedLeases requeues any job sitting in the processing list whose
+// lease has disappeared — its owning node crashed or was killed before
+// finishing, so the `SET NX PX` lease TTL'd out without the job ever being
+// removed from processing or credited in the results hash. Without this, a
+// node dying mid-job leaves rk.pending() stuck above zero forever and
+// assembleRedisResults spins indefinitely.
+func reapOrphanedLeases(client *redis.Client, rk redisKeys) {
+	raws, err := client.LRange(rk.processing(), 0, -1).Result()
+	if err != nil {
+		return
+	}
+
+	for _, raw := range raws {
+		var rj redisJob
+		if err := json.Unmarshal([]byte(raw), &rj); err != nil {
+			continue
+		}
+
+		exists, err := client.Exists(rk.lease(rj.Seq)).Result()
+		if err != nil || exists > 0 {
+			continue
+		}
+
+		if client.LRem(rk.processing(), 1, raw).Val() == 0 {
+			// another node already reaped this entry.
+			continue
+		}
+		logger.Printf("redis: requeuing orphaned job: %s\n", raw)
+		client.LPush(rk.queue(), raw)
+	}
+}
+
+// seedRedisQueue pushes cmdList into the Redis queue exactly once across
+// every cooperating node (guarded by a SETNX flag), crediting commands a
+// prior -journal run already completed straight to the results hash
+// instead of re-queueing them.
+func seedRedisQueue(client *redis.Client, rk redisKeys, resumed map[string]CommandResult) {
+	ok, err := client.SetNX(rk.seeded(), workerID(), 0).Result()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if !ok {
+		// another node already seeded the queue.
+		return
+	}
+
+	pending := 0
+	for i, n := range cmdList {
+		fullCmd := fmt.Sprintf("%s%s", cmdPrefix, n)
+		if prev, ok := resumed[fullCmd]; ok {
+			prev.Seq = i
+			b, _ := json.Marshal(prev)
+			client.HSet(rk.results(), fmt.Sprintf("%d", i), b)
+			continue
+		}
+
+		b, _ := json.Marshal(redisJob{Seq: i, Cmd: n})
+		if err := client.LPush(rk.queue(), b).Err(); err != nil {
+			logger.Fatal(err)
+		}
+		pending++
+	}
+
+	client.Set(rk.pending(), pending, 0)
+}
+
+// redisWorker pulls jobs off the Redis queue until the batch is drained,
+// running each one through the same -serial/-rate/driver/timeout plumbing
+// local runs use.
+func redisWorker(client *redis.Client, rk redisKeys, id string, jw *journalWriter, limiter <-chan time.Time, serialPermits map[string]chan struct{}) {
+	for {
+		if queueDrained(client, rk) {
+			return
+		}
+
+		raw, err := client.BRPopLPush(rk.queue(), rk.processing(), 5*time.Second).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			logger.Printf("redis worker %s: %s\n", id, err)
+			return
+		}
+
+		var rj redisJob
+		if err := json.Unmarshal([]byte(raw), &rj); err != nil {
+			logger.Printf("redis worker %s: bad job %q: %s\n", id, raw, err)
+			client.LRem(rk.processing(), 1, raw)
+			continue
+		}
+
+		leased, err := client.SetNX(rk.lease(rj.Seq), id, redisLeaseTTL).Result()
+		if err != nil || !leased {
+			// lost the race to own this job (e.g. a reaped, re-queued
+			// item another node already leased); leave it be and move on.
+			continue
+		}
+
+		cr := runJob(job{seq: rj.Seq, cmd: rj.Cmd}, limiter, serialPermits)
+		jw.Write(cr)
+
+		b, _ := json.Marshal(cr)
+		client.HSet(rk.results(), fmt.Sprintf("%d", rj.Seq), b)
+		client.LRem(rk.processing(), 1, raw)
+		client.Decr(rk.pending())
+	}
+}
+
+func queueDrained(client *redis.Client, rk redisKeys) bool {
+	pending, err := client.Get(rk.pending()).Int64()
+	if err != nil {
+		return false
+	}
+	return pending <= 0
+}
+
+// assembleRedisResults waits for every command to have a result in the
+// Redis hash, then returns them sorted back into sequence order so any
+// cooperating node produces the same final consolidated JSON.
+func assembleRedisResults(client *redis.Client, rk redisKeys) []CommandResult {
+	for !queueDrained(client, rk) {
+		time.Sleep(time.Second)
+	}
+
+	raw, err := client.HGetAll(rk.results()).Result()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	results := make([]CommandResult, 0, len(raw))
+	for _, v := range raw {
+		var cr CommandResult
+		if err := json.Unmarshal([]byte(v), &cr); err != nil {
+			continue
+		}
+		results = append(results, cr)
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Seq < results[j].Seq })
+	return results
+}
+
+// workerID identifies this process for job lease ownership.
+func workerID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
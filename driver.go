@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Driver executes lbaas operations and checks their completion status.
+// "cli" shells out to the neutron client for every call (the historical
+// behavior); "native" authenticates once and talks to Neutron LBaaSv2
+// directly through gophercloud.
+type Driver interface {
+	// Run executes fullCmd, e.g. "neutron lbaas-loadbalancer-create --name lb1 ...".
+	Run(ctx context.Context, fullCmd string) CommandResult
+	// Check waits for rlt's resource to leave any PENDING_* provisioning
+	// state and fills in rlt.Checked/CheckedDuration.
+	Check(ctx context.Context, rlt *CommandResult)
+}
+
+// NewDriver builds the Driver named by `-driver`.
+func NewDriver(name string) (Driver, error) {
+	switch name {
+	case "", "cli":
+		return cliDriver{}, nil
+	case "native":
+		return newNativeDriver()
+	default:
+		return nil, fmt.Errorf("unknown -driver %q, want \"cli\" or \"native\"", name)
+	}
+}
+
+// cliDriver shells out to the neutron CLI, re-authenticating on every call.
+type cliDriver struct{}
+
+func (cliDriver) Run(ctx context.Context, fullCmd string) CommandResult {
+	return RunCommand(ctx, fullCmd)
+}
+
+func (cliDriver) Check(ctx context.Context, rlt *CommandResult) {
+	CheckExecution(ctx, rlt)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/listeners"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/monitors"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
+)
+
+const (
+	checkBackoffBase = 500 * time.Millisecond
+	checkBackoffCap  = 30 * time.Second
+)
+
+// nativeDriver authenticates once against Keystone and reuses the resulting
+// ServiceClient for every LBaaSv2 call instead of re-authing a `neutron`
+// subprocess each time.
+type nativeDriver struct {
+	client *gophercloud.ServiceClient
+}
+
+func newNativeDriver() (Driver, error) {
+	opts, err := openstack.AuthOptionsFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("native driver: %s", err)
+	}
+
+	provider, err := openstack.AuthenticatedClient(opts)
+	if err != nil {
+		return nil, fmt.Errorf("native driver: %s", err)
+	}
+
+	client, err := openstack.NewNetworkV2(provider, gophercloud.EndpointOpts{
+		Region: os.Getenv("OS_REGION_NAME"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("native driver: %s", err)
+	}
+
+	return &nativeDriver{client: client}, nil
+}
+
+// parseLBaaSCommand splits a "neutron lbaas-<resource>-<operation> ..." line
+// into its resource type, operation, --flag values and any positional
+// arguments (e.g. the id for show/update/delete, the pool id for member-*).
+func parseLBaaSCommand(fullCmd string) (resourceType, operation string, opts map[string]string, positional []string) {
+	args := strings.Split(fullCmd, " ")
+	subs := strings.Split(args[1], "-")
+	resourceType, operation = subs[1], subs[2]
+
+	opts = map[string]string{}
+	for i := 2; i < len(args); i++ {
+		a := args[i]
+		if !strings.HasPrefix(a, "--") {
+			positional = append(positional, a)
+			continue
+		}
+
+		key := strings.TrimPrefix(a, "--")
+		if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+			opts[key] = args[i+1]
+			i++
+		} else {
+			opts[key] = ""
+		}
+	}
+	return
+}
+
+// toMap round-trips v through JSON so the native driver's results take the
+// same flat field shape (id, provisioning_status, ...) the neutron CLI's
+// `--format json` output has.
+func toMap(v interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]interface{}{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (d *nativeDriver) Run(ctx context.Context, fullCmd string) CommandResult {
+	cr := CommandResult{Command: fullCmd}
+
+	fs := time.Now()
+	resourceType, operation, opts, positional := parseLBaaSCommand(fullCmd)
+	out, err := d.dispatch(resourceType, operation, opts, positional)
+	cr.Duration = time.Since(fs)
+
+	if err != nil {
+		cr.Err = err.Error()
+		cr.ExitCode = 1
+		return cr
+	}
+	cr.Out = out
+	return cr
+}
+
+func (d *nativeDriver) dispatch(resourceType, operation string, opts map[string]string, positional []string) (map[string]interface{}, error) {
+	switch resourceType {
+	case "loadbalancer":
+		return d.loadbalancer(operation, opts, positional)
+	case "listener":
+		return d.listener(operation, opts, positional)
+	case "pool":
+		return d.pool(operation, opts, positional)
+	case "member":
+		return d.member(operation, opts, positional)
+	case "healthmonitor":
+		return d.healthmonitor(operation, opts, positional)
+	default:
+		return nil, fmt.Errorf("native driver: unsupported resource type %q", resourceType)
+	}
+}
+
+func (d *nativeDriver) loadbalancer(operation string, opts map[string]string, positional []string) (map[string]interface{}, error) {
+	switch operation {
+	case "create":
+		lb, err := loadbalancers.Create(d.client, loadbalancers.CreateOpts{
+			Name:        opts["name"],
+			Description: opts["description"],
+			VipSubnetID: opts["vip-subnet-id"],
+			VipAddress:  opts["vip-address"],
+		}).Extract()
+		if err != nil {
+			return nil, err
+		}
+		return toMap(lb)
+	case "update":
+		lb, err := loadbalancers.Update(d.client, positional[0], loadbalancers.UpdateOpts{
+			Name:        optStrPtr(opts, "name"),
+			Description: optStrPtr(opts, "description"),
+		}).Extract()
+		if err != nil {
+			return nil, err
+		}
+		return toMap(lb)
+	case "show":
+		lb, err := loadbalancers.Get(d.client, positional[0]).Extract()
+		if err != nil {
+			return nil, err
+		}
+		return toMap(lb)
+	case "delete":
+		if err := loadbalancers.Delete(d.client, positional[0]).ExtractErr(); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"id": positional[0]}, nil
+	case "list":
+		page, err := loadbalancers.List(d.client, loadbalancers.ListOpts{}).AllPages()
+		if err != nil {
+			return nil, err
+		}
+		lbs, err := loadbalancers.ExtractLoadBalancers(page)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"items": lbs}, nil
+	default:
+		return nil, fmt.Errorf("native driver: unsupported loadbalancer operation %q", operation)
+	}
+}
+
+func (d *nativeDriver) listener(operation string, opts map[string]string, positional []string) (map[string]interface{}, error) {
+	switch operation {
+	case "create":
+		l, err := listeners.Create(d.client, listeners.CreateOpts{
+			Name:           opts["name"],
+			Description:    opts["description"],
+			LoadbalancerID: opts["loadbalancer"],
+			Protocol:       listeners.Protocol(opts["protocol"]),
+			ProtocolPort:   atoi(opts["protocol-port"]),
+		}).Extract()
+		if err != nil {
+			return nil, err
+		}
+		return toMap(l)
+	case "update":
+		l, err := listeners.Update(d.client, positional[0], listeners.UpdateOpts{
+			Name:        optStrPtr(opts, "name"),
+			Description: optStrPtr(opts, "description"),
+		}).Extract()
+		if err != nil {
+			return nil, err
+		}
+		return toMap(l)
+	case "show":
+		l, err := listeners.Get(d.client, positional[0]).Extract()
+		if err != nil {
+			return nil, err
+		}
+		return toMap(l)
+	case "delete":
+		if err := listeners.Delete(d.client, positional[0]).ExtractErr(); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"id": positional[0]}, nil
+	default:
+		return nil, fmt.Errorf("native driver: unsupported listener operation %q", operation)
+	}
+}
+
+func (d *nativeDriver) pool(operation string, opts map[string]string, positional []string) (map[string]interface{}, error) {
+	switch operation {
+	case "create":
+		p, err := pools.Create(d.client, pools.CreateOpts{
+			Name:       opts["name"],
+			LBMethod:   pools.LBMethod(opts["lb-method"]),
+			Protocol:   pools.Protocol(opts["protocol"]),
+			ListenerID: opts["listener"],
+		}).Extract()
+		if err != nil {
+			return nil, err
+		}
+		return toMap(p)
+	case "update":
+		p, err := pools.Update(d.client, positional[0], pools.UpdateOpts{
+			Name:     optStrPtr(opts, "name"),
+			LBMethod: pools.LBMethod(opts["lb-method"]),
+		}).Extract()
+		if err != nil {
+			return nil, err
+		}
+		return toMap(p)
+	case "show":
+		p, err := pools.Get(d.client, positional[0]).Extract()
+		if err != nil {
+			return nil, err
+		}
+		return toMap(p)
+	case "delete":
+		if err := pools.Delete(d.client, positional[0]).ExtractErr(); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"id": positional[0]}, nil
+	default:
+		return nil, fmt.Errorf("native driver: unsupported pool operation %q", operation)
+	}
+}
+
+// member dispatches to pools.*Member: gophercloud has no standalone member
+// package, pool members are a sub-resource of pools keyed by (poolID, memberID).
+func (d *nativeDriver) member(operation string, opts map[string]string, positional []string) (map[string]interface{}, error) {
+	if len(positional) < 1 {
+		return nil, fmt.Errorf("native driver: member-%s requires a pool id", operation)
+	}
+	poolID := positional[0]
+
+	switch operation {
+	case "create":
+		m, err := pools.CreateMember(d.client, poolID, pools.CreateMemberOpts{
+			Address:      opts["address"],
+			ProtocolPort: atoi(opts["protocol-port"]),
+			SubnetID:     opts["subnet-id"],
+		}).Extract()
+		if err != nil {
+			return nil, err
+		}
+		return toMap(m)
+	case "update":
+		m, err := pools.UpdateMember(d.client, poolID, positional[1], pools.UpdateMemberOpts{
+			Weight: optIntPtr(opts, "weight"),
+		}).Extract()
+		if err != nil {
+			return nil, err
+		}
+		return toMap(m)
+	case "show":
+		m, err := pools.GetMember(d.client, poolID, positional[1]).Extract()
+		if err != nil {
+			return nil, err
+		}
+		return toMap(m)
+	case "delete":
+		if err := pools.DeleteMember(d.client, poolID, positional[1]).ExtractErr(); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"id": positional[1]}, nil
+	default:
+		return nil, fmt.Errorf("native driver: unsupported member operation %q", operation)
+	}
+}
+
+// healthmonitor dispatches to the lbaas_v2 "monitors" package — gophercloud
+// names it "monitors", not "healthmonitors".
+func (d *nativeDriver) healthmonitor(operation string, opts map[string]string, positional []string) (map[string]interface{}, error) {
+	switch operation {
+	case "create":
+		m, err := monitors.Create(d.client, monitors.CreateOpts{
+			PoolID:     opts["pool"],
+			Type:       opts["type"],
+			Delay:      atoi(opts["delay"]),
+			Timeout:    atoi(opts["timeout"]),
+			MaxRetries: atoi(opts["max-retries"]),
+		}).Extract()
+		if err != nil {
+			return nil, err
+		}
+		return toMap(m)
+	case "update":
+		m, err := monitors.Update(d.client, positional[0], monitors.UpdateOpts{
+			Delay: atoi(opts["delay"]),
+		}).Extract()
+		if err != nil {
+			return nil, err
+		}
+		return toMap(m)
+	case "show":
+		m, err := monitors.Get(d.client, positional[0]).Extract()
+		if err != nil {
+			return nil, err
+		}
+		return toMap(m)
+	case "delete":
+		if err := monitors.Delete(d.client, positional[0]).ExtractErr(); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"id": positional[0]}, nil
+	default:
+		return nil, fmt.Errorf("native driver: unsupported healthmonitor operation %q", operation)
+	}
+}
+
+// Check polls the resource through the same client instead of spawning a
+// neutron process, backing off exponentially (base 500ms, factor 2, capped
+// at 30s, +/-20% jitter) rather than busy-looping on PENDING_*, bounded by
+// `-check-timeout` when set.
+func (d *nativeDriver) Check(ctx context.Context, rlt *CommandResult) {
+	resourceType, operation, _, positional := parseLBaaSCommand(rlt.Command)
+
+	fs := time.Now()
+	defer func() { rlt.CheckedDuration = time.Since(fs) + rlt.Duration }()
+
+	if operation != "create" && operation != "update" {
+		rlt.Checked = fmt.Sprintf("%s done", resourceType)
+		return
+	}
+
+	id, _ := rlt.Out["id"].(string)
+
+	var deadline time.Time
+	if checkTimeout > 0 {
+		deadline = fs.Add(checkTimeout)
+	}
+
+	backoff := checkBackoffBase
+	for {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			rlt.Checked = fmt.Sprintf("Timed out checking execution of %s after %s", rlt.Command, checkTimeout)
+			return
+		}
+
+		out, err := d.show(resourceType, id, positional)
+		if err != nil {
+			rlt.Checked = fmt.Sprintf("Failed to check execution of %s: %s", rlt.Command, err)
+			return
+		}
+
+		b, _ := json.Marshal(out)
+		var stat NeutronResponse
+		_ = json.Unmarshal(b, &stat)
+		if !strings.HasPrefix(stat.ProvisioningStatus, "PENDING_") {
+			rlt.Checked = fmt.Sprintf("%s: %s", stat.ID, stat.ProvisioningStatus)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			rlt.Checked = fmt.Sprintf("Cancelled checking execution of %s: %s", rlt.Command, ctx.Err())
+			return
+		case <-time.After(jitter(backoff)):
+		}
+
+		backoff *= 2
+		if backoff > checkBackoffCap {
+			backoff = checkBackoffCap
+		}
+	}
+}
+
+// show builds the positional args a show call needs for resourceType. For
+// everything but members that's just [id]; for members it's [poolID, id] -
+// for member-create, positional only carries the pool id (the member id
+// doesn't exist at submit time, it comes back as rlt.Out["id"]), so the
+// member id from id must be appended rather than reusing positional as-is.
+func (d *nativeDriver) show(resourceType, id string, positional []string) (map[string]interface{}, error) {
+	if resourceType == "member" {
+		if len(positional) < 1 {
+			return nil, fmt.Errorf("native driver: member-show requires a pool id")
+		}
+		return d.dispatch(resourceType, "show", nil, []string{positional[0], id})
+	}
+	return d.dispatch(resourceType, "show", nil, []string{id})
+}
+
+// jitter returns d +/- 20%.
+func jitter(d time.Duration) time.Duration {
+	delta := float64(d) * 0.2
+	return d + time.Duration((rand.Float64()*2-1)*delta)
+}
+
+func atoi(s string) int {
+	n := 0
+	fmt.Sscanf(s, "%d", &n)
+	return n
+}
+
+// strPtr returns a pointer to s, for the *string fields gophercloud's
+// UpdateOpts types use to distinguish "leave unchanged" from "clear".
+func strPtr(s string) *string { return &s }
+
+// intPtr returns a pointer to n, for the *int fields gophercloud's
+// UpdateOpts types use to distinguish "leave unchanged" from "clear".
+func intPtr(n int) *int { return &n }
+
+// optStrPtr returns nil if key wasn't passed as a flag, or a pointer to its
+// value if it was - so an omitted --name/--description doesn't get sent to
+// gophercloud as an explicit empty string, which UpdateOpts' omitempty
+// wouldn't catch (it only skips nil, not a pointer to "") and would wipe
+// the field on the server.
+func optStrPtr(opts map[string]string, key string) *string {
+	if v, ok := opts[key]; ok {
+		return strPtr(v)
+	}
+	return nil
+}
+
+// optIntPtr is optStrPtr for the *int UpdateOpts fields (e.g. member Weight).
+func optIntPtr(opts map[string]string, key string) *int {
+	if v, ok := opts[key]; ok {
+		return intPtr(atoi(v))
+	}
+	return nil
+}
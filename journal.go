@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+)
+
+// journalWriter appends each CommandResult as a JSON line to `-journal` as
+// soon as it finishes, so a crash mid-batch only loses the commands that
+// were in flight rather than the whole run.
+type journalWriter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// newJournalWriter opens path for appending, or returns a nil *journalWriter
+// (safe to call Write/Close on) if path is empty.
+func newJournalWriter(path string) (*journalWriter, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &journalWriter{f: f}, nil
+}
+
+// Write appends cr as a single JSON line.
+func (j *journalWriter) Write(cr CommandResult) {
+	if j == nil {
+		return
+	}
+
+	b, err := json.Marshal(cr)
+	if err != nil {
+		logger.Printf("journal: failed to marshal result: %s\n", err)
+		return
+	}
+	b = append(b, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.Write(b); err != nil {
+		logger.Printf("journal: failed to append result: %s\n", err)
+	}
+}
+
+// Close closes the underlying file, if any.
+func (j *journalWriter) Close() {
+	if j == nil {
+		return
+	}
+	j.f.Close()
+}
+
+// loadResumeJournal reads a prior run's `-journal` file, passed as
+// `-resume`, and returns the commands that already succeeded, keyed by
+// their full command string, so a re-run can skip them.
+func loadResumeJournal(path string) (map[string]CommandResult, error) {
+	done := map[string]CommandResult{}
+	if path == "" {
+		return done, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return done, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var cr CommandResult
+		if err := json.Unmarshal(scanner.Bytes(), &cr); err != nil {
+			continue
+		}
+		if checkSucceeded(cr) {
+			done[cr.Command] = cr
+		}
+	}
+	return done, scanner.Err()
+}
+
+// checkSucceeded reports whether cr's backend check (if it had one) saw the
+// resource leave PENDING_* cleanly. ExitCode == 0 alone isn't enough: the
+// create/update call can succeed while the follow-up check times out, fails
+// or is cancelled, leaving the resource still PENDING_* — such a result
+// must not be treated as resumable.
+func checkSucceeded(cr CommandResult) bool {
+	if cr.ExitCode != 0 {
+		return false
+	}
+	return !strings.HasPrefix(cr.Checked, "Timed out checking execution of") &&
+		!strings.HasPrefix(cr.Checked, "Failed to check execution of") &&
+		!strings.HasPrefix(cr.Checked, "Cancelled checking execution of")
+}
@@ -2,16 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
-	"regexp"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	vartemplate "github.com/zongzw/f5-oslbaasv2-ops/template"
 )
 
 // StringArray array of string
@@ -45,14 +47,27 @@ var (
 	usage   = fmt.Sprintf("Usage: \n\n    %s [command arguments] -- <neutron command and arguments>[ ++ variable-definition]\n\n", os.Args[0])
 	example = fmt.Sprintf("Example:\n\n    %s --concurrency --output /dev/stdout \\\n    "+
 		"-- neutron lbaas-loadbalancer-create --name lb%s %s \\\n    ++ x:1-5 y:private-subnet,public-subnet\n\n", os.Args[0], "{x}", "{y}")
-	varRegexp = regexp.MustCompile(`%\{[a-zA-Z_][a-zA-Z0-9_]*\}`)
-	cmdList   = []string{}
-
-	concurrency int
-	output      string
+	cmdList = []string{}
+
+	concurrency  int
+	output       string
+	rate         float64
+	timeout      time.Duration
+	serialFlag   string
+	serial       = StringArray{}
+	driverFlag   string
+	checkTimeout time.Duration
+	stagesFlag   string
+	journalFlag  string
+	resumeFlag   string
+	redisFlag    string
+	progressFlag string
+	metricsFlag  string
 
 	cmdResults = []CommandResult{}
 	cmdPrefix  = "neutron lbaas-"
+	driver     Driver
+	progress   *Progress
 )
 
 func main() {
@@ -64,11 +79,43 @@ func main() {
 		os.Exit(1)
 	}
 
-	neutron, err := exec.LookPath("neutron")
+	var err error
+	driver, err = NewDriver(driverFlag)
 	if err != nil {
 		logger.Fatal(err)
 	}
-	logger.Printf("neutron command: %s\n", neutron)
+
+	serveMetrics(metricsFlag)
+
+	if driverFlag == "" || driverFlag == "cli" {
+		neutron, err := exec.LookPath("neutron")
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("neutron command: %s\n", neutron)
+	}
+
+	if stagesFlag != "" {
+		if journalFlag != "" || resumeFlag != "" || redisFlag != "" {
+			logger.Fatal("-journal, -resume and -redis are not supported with -stages")
+		}
+
+		sf, err := LoadStageFile(stagesFlag)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		// total command count isn't known up front in DAG mode, since
+		// child commands are generated as their parents complete.
+		progress = NewProgress(progressFlag, 0)
+		progress.Start()
+		defer progress.Stop()
+
+		results := RunStages(sf)
+		jd, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Printf("%s\n", jd)
+		return
+	}
 
 	RunCmds()
 
@@ -76,28 +123,191 @@ func main() {
 	fmt.Printf("%s\n", jd)
 }
 
-// RunCmds Execute the generated commands analyze result.
+// job is one queued command paired with its original position, so results
+// can be written back to cmdResults in the order they were generated.
+type job struct {
+	seq int
+	cmd string
+}
+
+// ResourceOperation extracts the lbaas resource type and operation (e.g.
+// "loadbalancer", "create") from a full neutron command line such as
+// "neutron lbaas-loadbalancer-create ...".
+func ResourceOperation(fullCmd string) (resourceType, operation string) {
+	args := strings.Split(fullCmd, " ")
+	subs := strings.Split(args[1], "-")
+	return subs[1], subs[2]
+}
+
+// ResourceType extracts just the lbaas resource type; see ResourceOperation.
+func ResourceType(fullCmd string) string {
+	resourceType, _ := ResourceOperation(fullCmd)
+	return resourceType
+}
+
+// RunCmds dispatches the generated commands to a pool of `concurrency`
+// workers and analyzes the results. Each resource type named in `-serial`
+// holds its own permit, so commands of that type run one at a time, while
+// every other resource type runs fully concurrently. No ordering is imposed
+// between different types: a listener may run alongside a loadbalancer. `-rate`
+// throttles how often a worker may start a new command, and `-timeout`
+// bounds each neutron call so a stuck worker can be cancelled.
+//
+// Every result is appended to `-journal` as soon as it finishes, and
+// `-resume` skips commands a prior journal already recorded as successful,
+// so a crashed batch can be picked back up without redoing finished work.
+// `-redis` hands the whole batch off to RunCmdsDistributed instead, so
+// multiple hosts can cooperate on it.
 func RunCmds() {
-	for i, n := range cmdList {
-		fullCmd := fmt.Sprintf("%s%s", cmdPrefix, n)
-		logger.Printf("Command(%d/%d): '%s' starts\n", i+1, len(cmdList), fullCmd)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	resumed, err := loadResumeJournal(resumeFlag)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	jw, err := newJournalWriter(journalFlag)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	defer jw.Close()
 
-		cr := RunCommand(fullCmd)
+	progress = NewProgress(progressFlag, len(cmdList))
+	for _, n := range cmdList {
+		progress.Queued(ResourceType(fmt.Sprintf("%s%s", cmdPrefix, n)))
+	}
+	progress.Start()
+	defer progress.Stop()
 
-		logger.Printf("Command '%s' exits with: %d, executing time: %s \n", cr.Command, cr.ExitCode, cr.Duration)
-		cmdResults = append(cmdResults, cr)
+	if redisFlag != "" {
+		cmdResults = RunCmdsDistributed(redisFlag, resumed, jw)
+		return
+	}
 
-		// check the command execution.
-		if cr.ExitCode != 0 {
+	serialPermits := newSerialPermits()
+	limiter := newRateLimiter()
+
+	jobs := make(chan job, len(cmdList))
+	results := make(chan CommandResult, len(cmdList))
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				cr := runJob(j, limiter, serialPermits)
+				jw.Write(cr)
+				results <- cr
+			}
+		}()
+	}
+
+	for i, n := range cmdList {
+		fullCmd := fmt.Sprintf("%s%s", cmdPrefix, n)
+		if prev, ok := resumed[fullCmd]; ok {
+			logger.Printf("Command(%d/%d): '%s' already succeeded, skipping (resume)\n", i+1, len(cmdList), fullCmd)
+			prev.Seq = i
+			resourceType, operation := ResourceOperation(fullCmd)
+			progress.Started(resourceType)
+			progress.Finished(resourceType, operation, prev)
+			results <- prev
 			continue
 		}
+		jobs <- job{seq: i, cmd: n}
+	}
+	close(jobs)
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// collector: the only goroutine that writes into cmdResults, indexed by
+	// the sequence number the command was generated with.
+	cmdResults = make([]CommandResult, len(cmdList))
+	for cr := range results {
+		cmdResults[cr.Seq] = cr
+	}
+}
+
+// runJob runs a single queued command, honoring the rate limiter and any
+// per-resource-type serialization permit, then checks its execution.
+func runJob(j job, limiter <-chan time.Time, serialPermits map[string]chan struct{}) CommandResult {
+	fullCmd := fmt.Sprintf("%s%s", cmdPrefix, j.cmd)
+
+	ctx := context.Background()
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	logger.Printf("Command(%d/%d): '%s' starts\n", j.seq+1, len(cmdList), fullCmd)
+	cr := executeCommand(ctx, fullCmd, limiter, serialPermits)
+	cr.Seq = j.seq
+	logger.Printf("Command '%s' exits with: %d, executing time: %s \n", cr.Command, cr.ExitCode, cr.Duration)
+
+	return cr
+}
+
+// newSerialPermits builds one capacity-1 permit channel per `-serial`
+// resource type, pre-filled so the first taker proceeds immediately; a
+// command of that resource type must hold the permit for the duration of
+// its run, serializing it against others of the same type.
+func newSerialPermits() map[string]chan struct{} {
+	serialPermits := map[string]chan struct{}{}
+	for _, t := range serial {
+		ch := make(chan struct{}, 1)
+		ch <- struct{}{}
+		serialPermits[t] = ch
+	}
+	return serialPermits
+}
+
+// newRateLimiter returns a `-rate` requests/sec ticker channel, or nil if
+// unset.
+func newRateLimiter() <-chan time.Time {
+	if rate <= 0 {
+		return nil
+	}
+	return time.NewTicker(time.Duration(float64(time.Second) / rate)).C
+}
+
+// executeCommand runs fullCmd through the same -serial mutual exclusion,
+// -rate limiting, driver and progress/metrics instrumentation the flat CLI's
+// worker pool uses, so any other caller (e.g. the DAG executor) gets
+// identical semantics.
+func executeCommand(ctx context.Context, fullCmd string, limiter <-chan time.Time, serialPermits map[string]chan struct{}) CommandResult {
+	resourceType, operation := ResourceOperation(fullCmd)
+
+	if permit, ok := serialPermits[resourceType]; ok {
+		<-permit
+		defer func() { permit <- struct{}{} }()
+	}
+
+	if limiter != nil {
+		<-limiter
+	}
+
+	progress.Started(resourceType)
+
+	cr := driver.Run(ctx, fullCmd)
+	if cr.ExitCode == 0 {
 		logger.Printf("Checking Execution: \n")
-		CheckExecution(cr)
+		driver.Check(ctx, &cr)
 	}
+
+	progress.Finished(resourceType, operation, cr)
+	recordMetrics(resourceType, operation, cr)
+
+	return cr
 }
 
 // CheckExecution check the execution in backend is done.
-func CheckExecution(rlt CommandResult) {
+func CheckExecution(ctx context.Context, rlt *CommandResult) {
 	args := strings.Split(rlt.Command, " ")
 	subs := strings.Split(args[1], "-")
 	resourceType, operation := subs[1], subs[2]
@@ -107,8 +317,19 @@ func CheckExecution(rlt CommandResult) {
 		checkCmd := fmt.Sprintf("neutron lbaas-%s-show %s", resourceType, rlt.Out["id"])
 		logger.Printf("Checking Command: %s\n", checkCmd)
 
-		for true {
-			cr := RunCommand(checkCmd)
+		var deadline time.Time
+		if checkTimeout > 0 {
+			deadline = fs.Add(checkTimeout)
+		}
+
+		backoff := checkBackoffBase
+		for {
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				rlt.Checked = fmt.Sprintf("Timed out checking execution of %s after %s", rlt.Command, checkTimeout)
+				break
+			}
+
+			cr := RunCommand(ctx, checkCmd)
 			if cr.ExitCode != 0 {
 				rlt.Checked = fmt.Sprintf("Failed to check execution of %s: %s", rlt.Command, cr.Err)
 				break
@@ -117,12 +338,24 @@ func CheckExecution(rlt CommandResult) {
 			var stat NeutronResponse
 			b, _ := json.Marshal(cr.Out)
 			_ = json.Unmarshal(b, &stat)
-			if strings.HasPrefix(stat.ProvisioningStatus, "PENDING_") {
-				continue
-			} else {
+			if !strings.HasPrefix(stat.ProvisioningStatus, "PENDING_") {
 				rlt.Checked = fmt.Sprintf("%s: %s", stat.ID, stat.ProvisioningStatus)
 				break
 			}
+
+			select {
+			case <-ctx.Done():
+				rlt.Checked = fmt.Sprintf("Cancelled checking execution of %s: %s", rlt.Command, ctx.Err())
+				fe := time.Now()
+				rlt.CheckedDuration = fe.Sub(fs) + rlt.Duration
+				return
+			case <-time.After(jitter(backoff)):
+			}
+
+			backoff *= 2
+			if backoff > checkBackoffCap {
+				backoff = checkBackoffCap
+			}
 		}
 	} else { // 'show' 'list' 'delete' no need to check
 		rlt.Checked = fmt.Sprintf("%s done", args[1])
@@ -132,12 +365,13 @@ func CheckExecution(rlt CommandResult) {
 	rlt.CheckedDuration = fe.Sub(fs) + rlt.Duration
 }
 
-// RunCommand run the command and fill CommandResult body
-func RunCommand(cmd string) CommandResult {
+// RunCommand run the command and fill CommandResult body. The command is
+// cancelled if ctx is done before it completes.
+func RunCommand(ctx context.Context, cmd string) CommandResult {
 	cmdArgs := strings.Split(cmd, " ")
 	cmdArgs = append(cmdArgs, "--format", "json")
 	var out, err bytes.Buffer
-	c := exec.Command(cmdArgs[0], cmdArgs[1:]...)
+	c := exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:]...)
 	c.Env = os.Environ()
 	c.Stdout = &out
 	c.Stderr = &err
@@ -177,13 +411,33 @@ func RunCommand(cmd string) CommandResult {
 
 // HandleArguments handle user's input.
 func HandleArguments() {
-	flag.IntVar(&concurrency, "concurrency", 1, "If or not do the operations concurrently.")
+	flag.IntVar(&concurrency, "concurrency", 1, "Number of worker goroutines executing commands in parallel.")
 	flag.StringVar(&output, "output", "/dev/stdout", "output the result")
+	flag.Float64Var(&rate, "rate", 0, "Max commands/sec started across all workers, 0 for unlimited.")
+	flag.DurationVar(&timeout, "timeout", 0, "Per-command timeout, e.g. 30s, 0 for unlimited.")
+	flag.StringVar(&serialFlag, "serial", "", "Comma-separated lbaas resource types (e.g. loadbalancer,listener) to serialize against themselves, while other types still run concurrently.")
+	flag.StringVar(&driverFlag, "driver", "cli", "Backend used to run lbaas operations: \"cli\" shells out to neutron, \"native\" talks to Neutron LBaaSv2 directly via gophercloud.")
+	flag.DurationVar(&checkTimeout, "check-timeout", 0, "Max time to wait for a resource to leave PENDING_*, e.g. 5m, 0 for unlimited.")
+	flag.StringVar(&stagesFlag, "stages", "", "Path to a multi-stage YAML template (stages: - name/command/variables/needs/bind) run as a DAG instead of the flat -- ... ++ CLI syntax.")
+	flag.StringVar(&journalFlag, "journal", "", "Append each CommandResult as a JSON line to this path as soon as it finishes.")
+	flag.StringVar(&resumeFlag, "resume", "", "Path to a prior -journal file; commands it recorded as successful are skipped on this run.")
+	flag.StringVar(&redisFlag, "redis", "", "Redis address (host:port); when set, cmdList is coordinated through Redis so multiple instances of this tool can cooperate on the same batch.")
+	flag.StringVar(&progressFlag, "progress", "plain", "Live progress rendering: \"tty\" for a redrawn table, \"plain\" for periodic log lines, \"none\" to disable.")
+	flag.StringVar(&metricsFlag, "metrics-listen", "", "Address (e.g. :9101) to serve Prometheus metrics on; unset disables the endpoint.")
 
 	flag.Usage = PrintUsage
 	flag.Parse()
 
-	logger.Printf("concurrency number: %v, output: %s\n", concurrency, output)
+	if serialFlag != "" {
+		serial = strings.Split(serialFlag, ",")
+	}
+
+	logger.Printf("concurrency number: %v, output: %s, rate: %v/s, timeout: %s, serial: %v, driver: %s, check-timeout: %s, stages: %s, journal: %s, resume: %s, redis: %s, progress: %s, metrics-listen: %s\n",
+		concurrency, output, rate, timeout, serial, driverFlag, checkTimeout, stagesFlag, journalFlag, resumeFlag, redisFlag, progressFlag, metricsFlag)
+
+	if stagesFlag != "" {
+		return
+	}
 
 	neutronArgsIndex := StringArray(os.Args).IndexOf("--")
 	if neutronArgsIndex == -1 {
@@ -209,7 +463,7 @@ func HandleArguments() {
 		}
 
 		if !varStart {
-			matches := varRegexp.FindAllString(n, -1)
+			matches := vartemplate.VarRegexp.FindAllString(n, -1)
 			for _, m := range matches {
 				logger.Printf("matched: %s\n", m)
 				l := len(m)
@@ -220,7 +474,7 @@ func HandleArguments() {
 			for k := range variables {
 				if strings.HasPrefix(n, fmt.Sprintf("%s:", k)) {
 					kvp := strings.Split(n, ":")
-					v := ParseVarValues(strings.Join(kvp[1:], ":"))
+					v := vartemplate.ParseValues(strings.Join(kvp[1:], ":"))
 					variables[k] = append(variables[k], v...)
 				}
 			}
@@ -243,47 +497,17 @@ func PrintUsage() {
 	fmt.Fprintf(os.Stderr, "\n")
 }
 
-// ConstructFromTemplate recursively generate the command from templete
-func ConstructFromTemplate(template string, variables map[string]StringArray) {
-	varInTmp := varRegexp.FindString(template)
-	if varInTmp == "" {
-		cmdList = append(cmdList, template)
-		return
-	}
-	l := len(varInTmp)
-	varName := varInTmp[2 : l-1]
-
-	r := regexp.MustCompile(varInTmp)
-
-	for _, k := range variables[varName] {
-		replaced := r.ReplaceAllString(template, k)
-		ConstructFromTemplate(replaced, variables)
-	}
-}
-
-// ParseVarValues parse the value ranges to actual value list
-// Supports: '-' num list and ',' list
-//		1-5
-// 		a,b,c
-// 		1-3,4,6-9,a,b,c
-func ParseVarValues(v string) []string {
-	rlt := []string{}
-	ls := strings.Split(v, ",")
-	p := regexp.MustCompile(`^\d+\-\d+$`)
-	for _, n := range ls {
-		matched := p.MatchString(n)
-		if matched {
-			se := strings.Split(n, "-")
-			s, _ := strconv.Atoi(se[0])
-			e, _ := strconv.Atoi(se[1])
-			for i := s; i <= e; i++ {
-				rlt = append(rlt, fmt.Sprintf("%d", i))
-			}
-		} else {
-			rlt = append(rlt, n)
-		}
+// ConstructFromTemplate expands tmpl's %{name} placeholders against
+// variables and appends every resulting command to cmdList. This is the
+// static resolution path of the template package, kept as its own function
+// so the flat `-- ... ++ x:1-5` CLI syntax is unaffected by the DAG stages
+// added alongside it.
+func ConstructFromTemplate(tmpl string, variables map[string]StringArray) {
+	static := vartemplate.StaticResolver{}
+	for k, v := range variables {
+		static[k] = []string(v)
 	}
-	return rlt
+	cmdList = append(cmdList, vartemplate.Expand(tmpl, static)...)
 }
 
 // IndexOf Implement the StringArray's IndexOf
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	cmdDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "oslbaas",
+		Name:      "command_duration_seconds",
+		Help:      "Duration of neutron lbaas command executions.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"resource", "operation"})
+
+	checkDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "oslbaas",
+		Name:      "check_duration_seconds",
+		Help:      "Duration spent waiting for a resource to leave PENDING_*.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"resource", "operation"})
+
+	cmdExitCodeTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oslbaas",
+		Name:      "command_exit_code_total",
+		Help:      "Count of command executions by resource, operation and exit code.",
+	}, []string{"resource", "operation", "exitcode"})
+)
+
+func init() {
+	prometheus.MustRegister(cmdDurationSeconds, checkDurationSeconds, cmdExitCodeTotal)
+}
+
+// serveMetrics exposes the registered collectors in Prometheus text format
+// at `-metrics-listen`, if set.
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Printf("metrics listener: %s\n", err)
+		}
+	}()
+	logger.Printf("metrics listening on %s/metrics\n", addr)
+}
+
+// recordMetrics updates the Prometheus collectors for one finished command.
+func recordMetrics(resourceType, operation string, cr CommandResult) {
+	cmdDurationSeconds.WithLabelValues(resourceType, operation).Observe(cr.Duration.Seconds())
+	if cr.CheckedDuration > cr.Duration {
+		checkDurationSeconds.WithLabelValues(resourceType, operation).Observe((cr.CheckedDuration - cr.Duration).Seconds())
+	}
+	cmdExitCodeTotal.WithLabelValues(resourceType, operation, fmt.Sprintf("%d", cr.ExitCode)).Inc()
+}
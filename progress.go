@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/olekukonko/tablewriter"
+)
+
+// progressCounts tallies one resource type's pending/running/succeeded/
+// failed commands.
+type progressCounts struct {
+	pending, running, succeeded, failed int
+}
+
+// Progress renders a live view of an in-flight batch per `-progress`
+// ("tty": a redrawn table; "plain": periodic log lines; "none"/"":
+// disabled), and collects the per resource-operation duration samples the
+// final p50/p90/p99 summary is built from. A nil *Progress is safe to call
+// every method on, so callers don't need to special-case "-progress=none".
+type Progress struct {
+	mode  string
+	total int
+	// autoTotal is set when NewProgress was given total==0 because the
+	// command count isn't known up front (DAG mode): Queued grows total
+	// as new commands are discovered instead of leaving it stuck at 0.
+	autoTotal bool
+
+	mu      sync.Mutex
+	counts  map[string]*progressCounts
+	samples map[string][]time.Duration
+	done    int
+	started time.Time
+
+	stop chan struct{}
+}
+
+// NewProgress builds a Progress for `total` commands rendered per mode.
+// Pass total==0 when the command count isn't known up front; Queued will
+// then grow total as commands are discovered.
+func NewProgress(mode string, total int) *Progress {
+	return &Progress{
+		mode:      mode,
+		total:     total,
+		autoTotal: total == 0,
+		counts:    map[string]*progressCounts{},
+		samples:   map[string][]time.Duration{},
+		started:   time.Now(),
+		stop:      make(chan struct{}),
+	}
+}
+
+func (p *Progress) ensure(resourceType string) *progressCounts {
+	c, ok := p.counts[resourceType]
+	if !ok {
+		c = &progressCounts{}
+		p.counts[resourceType] = c
+	}
+	return c
+}
+
+// Queued marks one command of resourceType as pending.
+func (p *Progress) Queued(resourceType string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.autoTotal {
+		p.total++
+	}
+	p.ensure(resourceType).pending++
+}
+
+// Started moves one command of resourceType from pending to running.
+func (p *Progress) Started(resourceType string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := p.ensure(resourceType)
+	c.pending--
+	c.running++
+}
+
+// Finished moves one command of resourceType from running to
+// succeeded/failed, and records its duration under "resourceType-operation"
+// for the final percentile summary.
+func (p *Progress) Finished(resourceType, operation string, cr CommandResult) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c := p.ensure(resourceType)
+	c.running--
+	if cr.ExitCode == 0 {
+		c.succeeded++
+	} else {
+		c.failed++
+	}
+	p.done++
+
+	key := fmt.Sprintf("%s-%s", resourceType, operation)
+	p.samples[key] = append(p.samples[key], cr.Duration)
+}
+
+// Start begins periodic rendering until Stop is called.
+func (p *Progress) Start() {
+	if p == nil || p.mode == "" || p.mode == "none" {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(2 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.render()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends rendering and prints the final p50/p90/p99 summary to stderr.
+func (p *Progress) Stop() {
+	if p == nil {
+		return
+	}
+	if p.mode != "" && p.mode != "none" {
+		close(p.stop)
+		p.render()
+	}
+	p.summarize()
+}
+
+func (p *Progress) render() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	elapsed := time.Since(p.started)
+	rate := float64(p.done) / elapsed.Seconds()
+
+	eta := "?"
+	if rate > 0 && p.done < p.total {
+		eta = time.Duration(float64(p.total-p.done) / rate * float64(time.Second)).Round(time.Second).String()
+	}
+
+	switch p.mode {
+	case "tty":
+		fmt.Fprint(os.Stderr, "\033[H\033[2J")
+		table := tablewriter.NewWriter(os.Stderr)
+		table.SetHeader([]string{"Resource", "Pending", "Running", "Succeeded", "Failed"})
+		for _, rt := range p.sortedTypes() {
+			c := p.counts[rt]
+			table.Append([]string{
+				rt,
+				fmt.Sprintf("%d", c.pending),
+				fmt.Sprintf("%d", c.running),
+				fmt.Sprintf("%d", c.succeeded),
+				fmt.Sprintf("%d", c.failed),
+			})
+		}
+		table.Render()
+		fmt.Fprintf(os.Stderr, "%s elapsed, ~%s remaining, %.1f ops/sec, %s/%s done\n",
+			elapsed.Round(time.Second), eta, rate, humanize.Comma(int64(p.done)), humanize.Comma(int64(p.total)))
+	case "plain":
+		logger.Printf("Progress: %s/%s done, %s elapsed, ~%s remaining, %.1f ops/sec\n",
+			humanize.Comma(int64(p.done)), humanize.Comma(int64(p.total)), elapsed.Round(time.Second), eta, rate)
+	}
+}
+
+func (p *Progress) sortedTypes() []string {
+	types := make([]string, 0, len(p.counts))
+	for t := range p.counts {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// summarize emits the final p50/p90/p99 duration stanza to stderr so slow
+// Neutron operations can be spotted without post-processing the JSON.
+func (p *Progress) summarize() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.samples) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(p.samples))
+	for k := range p.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(os.Stderr, "\n%-30s %10s %10s %10s %6s\n", "resource-operation", "p50", "p90", "p99", "n")
+	for _, k := range keys {
+		ds := append([]time.Duration{}, p.samples[k]...)
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		fmt.Fprintf(os.Stderr, "%-30s %10s %10s %10s %6d\n",
+			k, percentile(ds, 50), percentile(ds, 90), percentile(ds, 99), len(ds))
+	}
+}
+
+func percentile(sorted []time.Duration, pct int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := (len(sorted) - 1) * pct / 100
+	return sorted[idx]
+}
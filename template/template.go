@@ -0,0 +1,91 @@
+// Package template resolves %{name}-style placeholders in command
+// templates into the concrete commands to run. It supports two kinds of
+// resolver: a static one for values declared up front (the flat `++
+// x:1-5` CLI syntax) and a dynamic one for values captured out of a
+// parent command's result at run time (DAG stages' `bind:` clause).
+package template
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// VarRegexp matches a single "%{name}" placeholder.
+var VarRegexp = regexp.MustCompile(`%\{[a-zA-Z_][a-zA-Z0-9_]*\}`)
+
+// Resolver supplies the value set a named placeholder should expand to.
+type Resolver interface {
+	// Values returns name's values, or ok=false if the resolver has
+	// nothing for it.
+	Values(name string) (values []string, ok bool)
+}
+
+// StaticResolver resolves placeholders from a fixed set of values declared
+// up front.
+type StaticResolver map[string][]string
+
+// Values implements Resolver.
+func (s StaticResolver) Values(name string) ([]string, bool) {
+	v, ok := s[name]
+	return v, ok
+}
+
+// DynamicResolver resolves placeholders from a single late-bound value per
+// name, e.g. an id captured out of a parent stage's result.
+type DynamicResolver map[string]string
+
+// Values implements Resolver.
+func (d DynamicResolver) Values(name string) ([]string, bool) {
+	v, ok := d[name]
+	if !ok {
+		return nil, false
+	}
+	return []string{v}, true
+}
+
+// Expand recursively expands every placeholder in tmpl against resolver,
+// returning one command per combination of resolved values. A placeholder
+// resolver doesn't know about is left untouched.
+func Expand(tmpl string, resolver Resolver) []string {
+	for _, m := range VarRegexp.FindAllString(tmpl, -1) {
+		name := m[2 : len(m)-1]
+		values, ok := resolver.Values(name)
+		if !ok {
+			continue
+		}
+
+		r := regexp.MustCompile(m)
+		out := []string{}
+		for _, v := range values {
+			out = append(out, Expand(r.ReplaceAllString(tmpl, v), resolver)...)
+		}
+		return out
+	}
+	return []string{tmpl}
+}
+
+// ParseValues parses a value-range expression into its concrete value list.
+// Supports: '-' num ranges and ',' lists
+//		1-5
+// 		a,b,c
+// 		1-3,4,6-9,a,b,c
+func ParseValues(v string) []string {
+	rlt := []string{}
+	ls := strings.Split(v, ",")
+	p := regexp.MustCompile(`^\d+\-\d+$`)
+	for _, n := range ls {
+		if p.MatchString(n) {
+			se := strings.Split(n, "-")
+			s, _ := strconv.Atoi(se[0])
+			e, _ := strconv.Atoi(se[1])
+			for i := s; i <= e; i++ {
+				rlt = append(rlt, fmt.Sprintf("%d", i))
+			}
+		} else {
+			rlt = append(rlt, n)
+		}
+	}
+	return rlt
+}